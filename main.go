@@ -2,25 +2,40 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"golang.org/x/tools/go/packages"
 )
 
 const debouncePeriod = 200 * time.Millisecond
 
+// Supported values of the -format flag.
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatLSP  = "lsp"
+)
+
 func main() {
 	dir := flag.String("d", "", "Directory to start in")
+	format := flag.String("format", formatText, "Output format for test results: text, json or lsp")
+	matrixFlag := flag.String("matrix", "", "Comma-separated GOOS/GOARCH configurations to test under, e.g. linux/amd64,darwin/arm64")
+	tagsFlag := flag.String("tags", "", "Comma-separated build tags to pass to every configuration")
 	flag.Parse()
 	if *dir != "" {
 		if err := os.Chdir(*dir); err != nil {
@@ -28,14 +43,65 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	switch *format {
+	case formatText, formatJSON, formatLSP:
+	default:
+		fmt.Printf("Unknown -format %q: must be one of text, json, lsp\n", *format)
+		os.Exit(1)
+	}
+	matrix, err := parseMatrix(*matrixFlag)
+	if err != nil {
+		fmt.Printf("Invalid -matrix: %s\n", err)
+		os.Exit(1)
+	}
 
-	if err := run(); err != nil {
+	if err := run(*format, matrix, parseTags(*tagsFlag)); err != nil {
 		fmt.Printf("Running gotestwatch failed: %s\n", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+// A matrixConfig is one GOOS/GOARCH configuration to load and test packages under. The zero
+// value means "use the ambient `go env` configuration".
+type matrixConfig struct {
+	GOOS   string
+	GOARCH string
+}
+
+// String returns a short label for this configuration, used to group test output.
+func (m matrixConfig) String() string {
+	if m.GOOS == "" && m.GOARCH == "" {
+		return "ambient"
+	}
+	return m.GOOS + "/" + m.GOARCH
+}
+
+// parseMatrix parses a -matrix flag value into the set of configurations to test under,
+// defaulting to a single ambient configuration if none were given.
+func parseMatrix(s string) ([]matrixConfig, error) {
+	if s == "" {
+		return []matrixConfig{{}}, nil
+	}
+	var matrix []matrixConfig
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("configuration %q must be of the form GOOS/GOARCH", entry)
+		}
+		matrix = append(matrix, matrixConfig{GOOS: parts[0], GOARCH: parts[1]})
+	}
+	return matrix, nil
+}
+
+// parseTags parses a -tags flag value into a list of build tags.
+func parseTags(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func run(format string, matrix []matrixConfig, tags []string) error {
 	// Find the go.mod first
 	cmd := exec.Command("go", "env", "GOMOD")
 	cmd.Stderr = os.Stderr
@@ -52,50 +118,225 @@ func run() error {
 	if err := os.Chdir(dir); err != nil {
 		return fmt.Errorf("failed to change to %s: %w", dir, err)
 	}
-	pkgs, err := loadPackages()
-	if err != nil {
-		return err
-	}
 
-	// Set up watches
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("failed to set up filesystem watcher: %w", err)
 	}
-	for dir := range pkgs {
-		// N.B. UnportableCloseWrite is normally unexported. It doesn't work on all platforms.
-		if err := w.AddWith(dir, fsnotify.WithOps(fsnotify.UnportableCloseWrite)); err != nil {
-			return fmt.Errorf("failed to set up watch on %s: %w", dir, err)
+	state, err := loadWatchState(w, matrix, tags)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Watching %d directories across %d configuration(s)...\n", state.dirCount, len(state.graphs))
+	for {
+		// watchUntilReload reads w.Events/w.Errors itself, rather than a `for range` in run()
+		// binding to w once: that range would keep reading the old, now-closed channel forever
+		// after w is replaced below, so a module-graph reload would silently end the whole loop.
+		if err := watchUntilReload(w, state, format); !errors.Is(err, errReload) {
+			return err
+		}
+		// The module graph changed underneath us; don't trust any cached test results
+		// computed against the old one.
+		if err := state.cache.clear(); err != nil {
+			return fmt.Errorf("failed to clear test cache: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to tear down filesystem watcher: %w", err)
 		}
+		if w, err = fsnotify.NewWatcher(); err != nil {
+			return fmt.Errorf("failed to set up filesystem watcher: %w", err)
+		}
+		if state, err = loadWatchState(w, matrix, tags); err != nil {
+			return fmt.Errorf("failed to reload package graph: %w", err)
+		}
+		fmt.Printf("Reloaded %d directories across %d configuration(s)\n", state.dirCount, len(state.graphs))
 	}
-	revdeps := buildRevdeps(pkgs)
+}
 
-	fmt.Printf("Watching %d directories...\n", len(pkgs))
-	go func() {
-		for err := range w.Errors {
-			fmt.Printf("Error watching directories: %s\n", err)
-			os.Exit(1)
-		}
-	}()
-	for event := range w.Events {
-		fmt.Printf("%s changed", event.Name)
-		events := debounceFor(w.Events, debouncePeriod)
-		if len(events) != 0 {
-			fmt.Printf(" (and %d others)\n", len(events))
-		} else {
+// errReload is returned by watchUntilReload to signal that a module file (or a new subpackage
+// directory) changed and the caller should tear down w and rebuild the package graph, as
+// opposed to a genuine failure.
+var errReload = errors.New("reload")
+
+// watchUntilReload runs tests as files change until a go.mod/go.sum/go.work(.sum) change (or a
+// new subpackage directory) is seen, at which point it returns errReload so the caller can tear
+// down w and build a fresh watcher and state for the new package graph.
+func watchUntilReload(w *fsnotify.Watcher, state *watchState, format string) error {
+	for {
+		select {
+		case err, ok := <-w.Errors:
+			if !ok {
+				return fmt.Errorf("filesystem watcher closed unexpectedly")
+			}
+			return fmt.Errorf("error watching directories: %w", err)
+		case event, ok := <-w.Events:
+			if !ok {
+				return fmt.Errorf("filesystem watcher closed unexpectedly")
+			}
+			if state.isModuleEvent(event) {
+				fmt.Printf("%s changed, reloading package graph...\n", event.Name)
+				debounceFor(w.Events, debouncePeriod)
+				return errReload
+			}
+			fmt.Printf("%s changed", event.Name)
+			events := debounceFor(w.Events, debouncePeriod)
+			if len(events) != 0 {
+				fmt.Printf(" (and %d others)\n", len(events))
+			} else {
+				fmt.Println("")
+			}
+			filenames := []string{event.Name}
+			for _, event := range events {
+				filenames = append(filenames, event.Name)
+			}
+			// Run affected tests
+			if err := state.runAllTests(filenames, format); err != nil {
+				fmt.Printf("Tests failed: %s\n", err)
+			}
 			fmt.Println("")
 		}
-		filenames := []string{event.Name}
-		for _, event := range events {
-			filenames = append(filenames, event.Name)
+	}
+}
+
+// watchState holds everything that depends on the current package graph, so it can be
+// torn down and rebuilt wholesale whenever go.mod, go.sum or the module layout changes.
+type watchState struct {
+	graphs      []*configGraph
+	dirCount    int
+	moduleFiles []string
+	parentDirs  []string
+	modulePath  string
+	goVersion   string
+	tags        []string
+	cache       *testCache
+}
+
+// configGraph is the package graph loaded for one matrixConfig: its own GOOS/GOARCH (and the
+// shared build tags) can make a different set of files live, ignored or imported.
+type configGraph struct {
+	config       matrixConfig
+	pkgs         map[string]*Package
+	byImportPath map[string]*Package
+	revdeps      map[string][]*Package
+}
+
+// loadWatchState loads the package graph for every configuration in matrix and establishes
+// filesystem watches on the union of their package directories, plus go.mod/go.sum/go.work(.sum),
+// plus each watched directory's parent so a newly created subpackage is itself noticed.
+func loadWatchState(w *fsnotify.Watcher, matrix []matrixConfig, tags []string) (*watchState, error) {
+	s := &watchState{tags: tags}
+	dirs := map[string]bool{}
+	for _, config := range matrix {
+		pkgs, err := loadPackages(config.GOOS, config.GOARCH, tags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load packages for %s: %w", config, err)
+		}
+		g := &configGraph{
+			config:       config,
+			pkgs:         pkgs,
+			byImportPath: map[string]*Package{},
+			revdeps:      buildRevdeps(pkgs),
+		}
+		for dir, pkg := range pkgs {
+			g.byImportPath[pkg.PkgPath] = pkg
+			dirs[dir] = true
+			if s.modulePath == "" && pkg.Module != nil {
+				s.modulePath = pkg.Module.Path
+			}
+		}
+		s.graphs = append(s.graphs, g)
+	}
+	var err error
+	if s.goVersion, err = goVersion(); err != nil {
+		return nil, err
+	}
+	if s.cache, err = loadTestCache(s.modulePath); err != nil {
+		return nil, err
+	}
+	s.moduleFiles, err = findModuleFiles()
+	if err != nil {
+		return nil, err
+	}
+	parents := map[string]bool{}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			return nil, fmt.Errorf("failed to set up watch on %s: %w", dir, err)
+		}
+		parents[filepath.Dir(dir)] = true
+	}
+	for _, f := range s.moduleFiles {
+		if err := w.Add(f); err != nil {
+			return nil, fmt.Errorf("failed to set up watch on %s: %w", f, err)
+		}
+		parents[filepath.Dir(f)] = true
+	}
+	for dir := range parents {
+		s.parentDirs = append(s.parentDirs, dir)
+		if dirs[dir] {
+			// Already watched as a package directory.
+			continue
+		}
+		// We only care about Create here (a new subpackage directory appearing), but fsnotify
+		// doesn't let Add filter by op, so isModuleEvent does that filtering itself instead.
+		if err := w.Add(dir); err != nil {
+			return nil, fmt.Errorf("failed to set up watch on %s: %w", dir, err)
 		}
-		// Run affected tests
-		if err := runAllTests(pkgs, revdeps, filenames); err != nil {
-			fmt.Printf("Tests failed: %s\n", err)
+	}
+	s.dirCount = len(dirs)
+	return s, nil
+}
+
+// isModuleEvent reports whether an event should trigger a full reload of the package graph,
+// because it touches go.mod/go.sum/go.work(.sum), or creates a new directory (a likely new
+// subpackage) inside the parent directory of a package directory or module file.
+func (s *watchState) isModuleEvent(event fsnotify.Event) bool {
+	if slices.Contains(s.moduleFiles, event.Name) {
+		return true
+	}
+	if event.Op.Has(fsnotify.Create) && slices.Contains(s.parentDirs, filepath.Dir(event.Name)) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// findModuleFiles returns the go.mod/go.sum and, if this is a workspace, go.work/go.work.sum
+// paths for the current module, omitting any that don't exist.
+func findModuleFiles() ([]string, error) {
+	cmd := exec.Command("go", "env", "GOMOD", "GOWORK")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run `go env GOMOD GOWORK`: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	var candidates []string
+	if len(lines) > 0 && lines[0] != "" && lines[0] != "/dev/null" {
+		candidates = append(candidates, lines[0], filepath.Join(filepath.Dir(lines[0]), "go.sum"))
+	}
+	if len(lines) > 1 && lines[1] != "" && lines[1] != "/dev/null" {
+		candidates = append(candidates, lines[1], filepath.Join(filepath.Dir(lines[1]), "go.work.sum"))
+	}
+	files := make([]string, 0, len(candidates))
+	for _, f := range candidates {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
 		}
-		fmt.Println("")
 	}
-	return nil
+	return files, nil
+}
+
+// goVersion returns the Go toolchain version in use, e.g. "go1.23.0". It's folded into the
+// test cache's input hash so a toolchain upgrade invalidates every cached result.
+func goVersion() (string, error) {
+	cmd := exec.Command("go", "env", "GOVERSION")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run `go env GOVERSION`: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
 }
 
 // debounceFor reads all events from a channel for up to the given period of time.
@@ -112,61 +353,240 @@ func debounceFor[T any](ch <-chan T, duration time.Duration) []T {
 	}
 }
 
-// loadPackages finds all Go packages within this module
-func loadPackages() (map[string]*Package, error) {
-	cmd := exec.Command("go", "list", "-json", "./...")
-	cmd.Stderr = os.Stderr
-	out, err := cmd.Output()
+// packagesLoadMode is the set of information we need packages.Load to compute for us.
+const packagesLoadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports |
+	packages.NeedDeps | packages.NeedModule | packages.NeedEmbedFiles | packages.NeedCompiledGoFiles
+
+// loadPackages finds all Go packages within this module, including their test variants.
+func loadPackages(goos, goarch string, tags []string) (map[string]*Package, error) {
+	cfg := &packages.Config{
+		Mode:  packagesLoadMode,
+		Tests: true,
+	}
+	if goos != "" || goarch != "" {
+		env := append(slices.Clone(os.Environ()), "GOOS="+goos, "GOARCH="+goarch)
+		cfg.Env = env
+	}
+	if len(tags) > 0 {
+		cfg.BuildFlags = []string{"-tags=" + strings.Join(tags, ",")}
+	}
+	loaded, err := packages.Load(cfg, "./...")
 	if err != nil {
-		return nil, fmt.Errorf("failed to run `go list -json ./...`: %w", err)
+		return nil, fmt.Errorf("failed to load packages: %w", err)
+	}
+	if packages.PrintErrors(loaded) > 0 {
+		return nil, fmt.Errorf("errors loading packages, see above")
 	}
-	d := json.NewDecoder(bytes.NewReader(out))
 	pkgs := map[string]*Package{}
-	for {
-		pkg := &Package{}
-		if err := d.Decode(pkg); err != nil {
-			if err == io.EOF {
-				return pkgs, nil
-			}
-			return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	byID := map[string]*packages.Package{}
+	for _, p := range loaded {
+		byID[p.ID] = p
+	}
+	// First pass: find the "real" (non-test-binary) package for each directory, and pull its
+	// non-Go source and embed files (cgo needs CompiledGoFiles/OtherFiles rather than anything
+	// TestGoFiles-shaped) off of the underlying *packages.Package.
+	for _, p := range loaded {
+		if isTestBinaryVariant(p.ID) {
+			continue
+		}
+		dir := packageDir(p)
+		if dir == "" {
+			continue
+		}
+		cFiles, hFiles, sFiles, sysoFiles := classifyOtherFiles(p.OtherFiles)
+		pkgs[dir] = &Package{
+			Package:    p,
+			Dir:        dir,
+			GoFiles:    basenames(p.GoFiles),
+			EmbedFiles: basenames(p.EmbedFiles),
+			CgoFiles:   cgoFiles(p.GoFiles, p.CompiledGoFiles),
+			CFiles:     cFiles,
+			HFiles:     hFiles,
+			SFiles:     sFiles,
+			SysoFiles:  sysoFiles,
+		}
+	}
+	// Second pass: fold the synthetic internal/external test packages back into it, so
+	// a package's own struct carries its TestGoFiles and XTestGoFiles like `go list` gave us.
+	for _, p := range loaded {
+		if !isTestBinaryVariant(p.ID) {
+			continue
+		}
+		dir := packageDir(p)
+		pkg, present := pkgs[dir]
+		if !present {
+			continue
+		}
+		if strings.HasSuffix(p.PkgPath, "_test") {
+			pkg.XTestGoFiles = append(pkg.XTestGoFiles, newGoFiles(p.GoFiles, nil)...)
+			pkg.XTestImports = append(pkg.XTestImports, importPaths(p, byID)...)
+		} else {
+			pkg.TestGoFiles = append(pkg.TestGoFiles, newGoFiles(p.GoFiles, pkg.Package.GoFiles)...)
+			pkg.TestImports = append(pkg.TestImports, importPaths(p, byID)...)
+		}
+		pkg.testVariants = append(pkg.testVariants, p)
+	}
+	return pkgs, nil
+}
+
+// basenames strips every path down to its file name.
+func basenames(paths []string) []string {
+	ret := make([]string, len(paths))
+	for i, p := range paths {
+		ret[i] = filepath.Base(p)
+	}
+	return ret
+}
+
+// classifyOtherFiles splits a package's OtherFiles (anything that isn't Go source) by
+// extension into the file kinds the build actually cares about.
+func classifyOtherFiles(paths []string) (cFiles, hFiles, sFiles, sysoFiles []string) {
+	for _, p := range paths {
+		name := filepath.Base(p)
+		switch filepath.Ext(name) {
+		case ".c":
+			cFiles = append(cFiles, name)
+		case ".h":
+			hFiles = append(hFiles, name)
+		case ".s", ".S":
+			sFiles = append(sFiles, name)
+		case ".syso":
+			sysoFiles = append(sysoFiles, name)
+		}
+	}
+	return
+}
+
+// cgoFiles returns the original source files that cgo preprocessing replaced with generated
+// ones: they're present in GoFiles (the source list) but absent from CompiledGoFiles (the
+// list of what's actually fed to the compiler).
+func cgoFiles(goFiles, compiledGoFiles []string) []string {
+	compiled := map[string]bool{}
+	for _, f := range compiledGoFiles {
+		compiled[filepath.Base(f)] = true
+	}
+	var ret []string
+	for _, f := range goFiles {
+		if name := filepath.Base(f); !compiled[name] {
+			ret = append(ret, name)
 		}
-		pkgs[pkg.Dir] = pkg
 	}
+	return ret
+}
+
+// isTestBinaryVariant reports whether a package ID is one of the synthetic packages
+// that packages.Load produces for a test binary, e.g. "example.com/foo [example.com/foo.test]".
+func isTestBinaryVariant(id string) bool {
+	return strings.Contains(id, ".test]") || strings.HasSuffix(id, ".test")
+}
+
+// packageDir returns the directory a package's files live in.
+func packageDir(p *packages.Package) string {
+	if len(p.GoFiles) == 0 {
+		return ""
+	}
+	return filepath.Dir(p.GoFiles[0])
+}
+
+// newGoFiles returns the base names of any file in files that isn't already present in exclude.
+func newGoFiles(files, exclude []string) []string {
+	ret := make([]string, 0, len(files))
+	for _, f := range files {
+		if !slices.Contains(exclude, f) {
+			ret = append(ret, filepath.Base(f))
+		}
+	}
+	return ret
+}
+
+// importPaths returns the import paths of a package's direct imports.
+func importPaths(p *packages.Package, byID map[string]*packages.Package) []string {
+	ret := make([]string, 0, len(p.Imports))
+	for _, imp := range p.Imports {
+		ret = append(ret, imp.PkgPath)
+	}
+	return ret
 }
 
-// A Package is a minimal model of a Go package described by go list
+// A Package is a minimal model of a Go package, built on top of golang.org/x/tools/go/packages.
+// All file lists here are base names, not paths, so they can be compared directly against
+// the names fsnotify hands us.
 type Package struct {
-	Dir            string   `json:"Dir"`
-	ImportPath     string   `json:"ImportPath"`
-	Deps           []string `json:"Deps"`
-	GoFiles        []string `json:"GoFiles"`
-	IgnoredGoFiles []string `json:"IgnoredGoFiles"`
-	TestGoFiles    []string `json:"TestGoFiles"`
-	XTestGoFiles   []string `json:"XTestGoFiles"`
-	EmbedFiles     []string `json:"EmbedFiles"`
-	TestImports    []string `json:"TestImports"`
-	XTestImports   []string `json:"XTestImports"`
-	// TODO(peter): We might need to think about cgo here? Are there any other relevant file types on this thing?
-	Module struct {
-		Path string `json:"Path"`
-	} `json:"Module"`
+	*packages.Package
+	// Dir is the absolute path of the directory this package's files live in.
+	Dir string
+	// GoFiles and EmbedFiles shadow the promoted fields from packages.Package with their
+	// base-name equivalents.
+	GoFiles    []string
+	EmbedFiles []string
+	// TestGoFiles and XTestGoFiles are the internal (package foo) and external (package foo_test)
+	// test files for this package, folded back in from the synthetic test-binary packages.
+	TestGoFiles  []string
+	XTestGoFiles []string
+	// TestImports and XTestImports are the direct import paths of the internal and external test
+	// variants respectively; the internal variant's list also includes the package's own imports.
+	TestImports  []string
+	XTestImports []string
+	// testVariants holds the synthetic internal/external test packages packages.Load produced
+	// for this package (e.g. "example.com/foo [example.com/foo.test]"), kept around so
+	// buildRevdeps can walk their full transitive imports rather than just the direct ones
+	// flattened into TestImports/XTestImports above.
+	testVariants []*packages.Package
+	// CgoFiles, CFiles, HFiles, SFiles and SysoFiles are the non-Go source files the build
+	// consults: cgo-preprocessed .go files, and plain .c/.h/.s/.syso files respectively.
+	CgoFiles  []string
+	CFiles    []string
+	HFiles    []string
+	SFiles    []string
+	SysoFiles []string
+}
+
+// IgnoredGoFiles returns the Go files in this package's directory that were excluded by
+// build constraints, e.g. a //go:build tag for another platform.
+func (p *Package) IgnoredGoFiles() []string {
+	ignored := make([]string, 0, len(p.Package.IgnoredFiles))
+	for _, f := range p.Package.IgnoredFiles {
+		if strings.HasSuffix(f, ".go") {
+			ignored = append(ignored, filepath.Base(f))
+		}
+	}
+	return ignored
+}
+
+// knownFiles returns every file gotestwatch recognises as belonging to this package, whether
+// or not it's actually compiled in the current configuration (see IgnoredGoFiles).
+func (p *Package) knownFiles() []string {
+	known := slices.Concat(p.GoFiles, p.TestGoFiles, p.XTestGoFiles, p.EmbedFiles,
+		p.CgoFiles, p.CFiles, p.HFiles, p.SFiles, p.SysoFiles, p.IgnoredGoFiles())
+	return known
 }
 
 // buildRevdeps builds a reverse dependency map of all tests that depend on each package.
+// This fully traverses the transitive dependency graph (via NeedDeps) starting from both a
+// package's own node and its synthetic test-binary variants, so it also covers a package
+// that's only reachable transitively through a test-only import (e.g. foo_test imports bar,
+// and bar imports baz: baz must end up in revdeps as depended on by foo).
 func buildRevdeps(pkgs map[string]*Package) map[string][]*Package {
 	revdeps := map[string][]*Package{}
 	for _, pkg := range pkgs {
-		for _, dep := range pkg.Deps {
-			if strings.HasPrefix(dep, pkg.Module.Path) {
-				revdeps[dep] = append(revdeps[dep], pkg)
+		modulePath := pkg.Module.Path
+		seen := map[string]bool{}
+		var walk func(p *packages.Package)
+		walk = func(p *packages.Package) {
+			for path, imp := range p.Imports {
+				if seen[path] {
+					continue
+				}
+				seen[path] = true
+				if strings.HasPrefix(path, modulePath) && !slices.Contains(revdeps[path], pkg) {
+					revdeps[path] = append(revdeps[path], pkg)
+				}
+				walk(imp)
 			}
 		}
-		// Deps don't include test deps.
-		// TODO(peter): These import fields aren't recursive so we could miss something.
-		for _, imp := range append(pkg.TestImports, pkg.XTestImports...) {
-			if strings.HasPrefix(imp, pkg.Module.Path) && !slices.Contains(revdeps[imp], pkg) {
-				revdeps[imp] = append(revdeps[imp], pkg)
-			}
+		walk(pkg.Package)
+		for _, p := range pkg.testVariants {
+			walk(p)
 		}
 	}
 	return revdeps
@@ -177,9 +597,12 @@ func testsToRun(pkg *Package, revdeps []*Package, filenames []string) []*Package
 	if len(revdeps) == 0 {
 		return nil
 	}
-	// Excise any files that are ignored (e.g. excluded by build constraints)
+	// Excise any files that are ignored (e.g. excluded by build constraints), and any files
+	// we don't recognise as part of the package at all (e.g. a stray README.md).
+	ignored := pkg.IgnoredGoFiles()
+	known := pkg.knownFiles()
 	filenames = slices.DeleteFunc(filenames, func(filename string) bool {
-		return slices.Contains(pkg.IgnoredGoFiles, filename)
+		return slices.Contains(ignored, filename) || !slices.Contains(known, filename)
 	})
 	if len(filenames) == 0 {
 		return nil
@@ -195,50 +618,369 @@ func testsToRun(pkg *Package, revdeps []*Package, filenames []string) []*Package
 	return append(toRun, pkg)
 }
 
-// runAllTests runs all tests possibly affected by changes to the given files
-func runAllTests(pkgs map[string]*Package, revdeps map[string][]*Package, filenames []string) error {
+// cacheEntry records the input hash a package's tests were last run with, and whether they passed.
+type cacheEntry struct {
+	Hash   string `json:"hash"`
+	Passed bool   `json:"passed"`
+}
+
+// testCache is an on-disk record of per-package test outcomes, keyed by configuration and
+// import path, so a package whose inputs haven't changed since it last passed under a given
+// configuration doesn't need to be rerun.
+type testCache struct {
+	path    string
+	entries map[string]cacheEntry
+}
+
+// loadTestCache loads the cache for the given module from $XDG_CACHE_HOME/gotestwatch/<module>/,
+// returning an empty cache if none exists yet.
+func loadTestCache(modulePath string) (*testCache, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user cache directory: %w", err)
+	}
+	c := &testCache{
+		path:    filepath.Join(base, "gotestwatch", modulePath, "cache.json"),
+		entries: map[string]cacheEntry{},
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read test cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		// A corrupt cache shouldn't take down the whole run; just start fresh.
+		c.entries = map[string]cacheEntry{}
+	}
+	return c, nil
+}
+
+// hit reports whether key last passed its tests with exactly this input hash.
+func (c *testCache) hit(key, hash string) bool {
+	e, present := c.entries[key]
+	return present && e.Hash == hash && e.Passed
+}
+
+// record stores the outcome of running key's tests against the given input hash.
+func (c *testCache) record(key, hash string, passed bool) {
+	c.entries[key] = cacheEntry{Hash: hash, Passed: passed}
+}
+
+// clear discards every cached outcome and persists the now-empty cache, used when the module
+// graph is reloaded and old hashes can no longer be trusted.
+func (c *testCache) clear() error {
+	c.entries = map[string]cacheEntry{}
+	return c.save()
+}
+
+// save persists the cache to disk.
+func (c *testCache) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create test cache directory: %w", err)
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal test cache: %w", err)
+	}
+	return os.WriteFile(c.path, data, 0o644)
+}
+
+// computePackageHash hashes a package's own source, test, embed and non-Go build inputs
+// (cgo/.c/.h/.s/.syso files) together with the hashes of its transitive in-module dependencies
+// (including those imported only by its tests) and the active Go toolchain version, so any of
+// those changing is enough to invalidate the cache. memo is reused across the call tree to
+// avoid rehashing a shared dependency many times over.
+func computePackageHash(pkg *Package, byImportPath map[string]*Package, goVersion string, memo map[string]string) string {
+	if h, present := memo[pkg.PkgPath]; present {
+		return h
+	}
+	// Mark pkg as in progress, so a cycle through test-only imports stops here.
+	memo[pkg.PkgPath] = ""
+	hasher := sha256.New()
+	hasher.Write([]byte(goVersion))
+	files := slices.Concat(pkg.GoFiles, pkg.TestGoFiles, pkg.XTestGoFiles, pkg.EmbedFiles,
+		pkg.CgoFiles, pkg.CFiles, pkg.HFiles, pkg.SFiles, pkg.SysoFiles)
+	slices.Sort(files)
+	for _, f := range files {
+		if data, err := os.ReadFile(filepath.Join(pkg.Dir, f)); err == nil {
+			hasher.Write(data)
+		}
+	}
+	deps := make([]string, 0, len(pkg.Imports))
+	for path := range pkg.Imports {
+		deps = append(deps, path)
+	}
+	for _, tv := range pkg.testVariants {
+		for path := range tv.Imports {
+			if path != pkg.PkgPath {
+				deps = append(deps, path)
+			}
+		}
+	}
+	slices.Sort(deps)
+	deps = slices.Compact(deps)
+	for _, path := range deps {
+		if dep, present := byImportPath[path]; present {
+			hasher.Write([]byte(computePackageHash(dep, byImportPath, goVersion, memo)))
+		}
+	}
+	h := hex.EncodeToString(hasher.Sum(nil))
+	memo[pkg.PkgPath] = h
+	return h
+}
+
+// runAllTests finds the tests affected by filenames in every configuration and runs them,
+// reporting results grouped by configuration.
+func (s *watchState) runAllTests(filenames []string, format string) error {
 	byDir := map[string][]string{}
 	for _, filename := range filenames {
 		dir, filename := filepath.Split(filename)
 		dir = strings.TrimSuffix(dir, "/")
 		byDir[dir] = append(byDir[dir], filename)
 	}
-	toRun := []*Package{}
-	for dir, files := range byDir {
-		pkg, present := pkgs[dir]
-		if !present {
+	var failed error
+	for _, g := range s.graphs {
+		toRun := []*Package{}
+		for dir, files := range byDir {
+			pkg, present := g.pkgs[dir]
+			if !present {
+				continue
+			}
+			toRun = append(toRun, testsToRun(pkg, g.revdeps[pkg.PkgPath], files)...)
+		}
+		// Only run tests in packages that have tests in them
+		toRun = slices.DeleteFunc(toRun, func(pkg *Package) bool {
+			return len(pkg.TestGoFiles) == 0 && len(pkg.XTestGoFiles) == 0
+		})
+		// Make these unique
+		slices.SortFunc(toRun, func(a, b *Package) int { return strings.Compare(a.PkgPath, b.PkgPath) })
+		toRun = slices.CompactFunc(toRun, func(a, b *Package) bool { return a.PkgPath == b.PkgPath })
+		if len(toRun) == 0 {
 			continue
 		}
-		toRun = append(toRun, testsToRun(pkg, revdeps[pkg.ImportPath], files)...)
+
+		hashes := map[string]string{}
+		for _, pkg := range toRun {
+			hashes[pkg.PkgPath] = computePackageHash(pkg, g.byImportPath, s.goVersion, map[string]string{})
+		}
+		skipped := 0
+		toRun = slices.DeleteFunc(toRun, func(pkg *Package) bool {
+			if s.cache.hit(cacheKey(g.config, s.tags, pkg.PkgPath), hashes[pkg.PkgPath]) {
+				skipped++
+				return true
+			}
+			return false
+		})
+		prefix := ""
+		if len(s.graphs) > 1 {
+			prefix = fmt.Sprintf("[%s] ", g.config)
+		}
+		if skipped > 0 {
+			fmt.Printf("%sSkipping %d package(s) with unchanged inputs and a cached pass\n", prefix, skipped)
+		}
+		if len(toRun) == 0 {
+			fmt.Printf("%sNo affected tests to run\n", prefix)
+			continue
+		} else if len(toRun) == 1 {
+			fmt.Printf("%sRunning tests in 1 package...\n", prefix)
+		} else {
+			fmt.Printf("%sRunning tests in %d packages...\n", prefix, len(toRun))
+		}
+		if err := s.runTests(g, toRun, hashes, format); err != nil {
+			failed = err
+		}
 	}
-	// Only run tests in packages that have tests in them
-	toRun = slices.DeleteFunc(toRun, func(pkg *Package) bool {
-		return len(pkg.TestGoFiles) == 0 && len(pkg.XTestGoFiles) == 0
-	})
+	return failed
+}
+
+// cacheKey namespaces a test cache entry by the configuration it was run under, since the
+// same package can compile to something different (or not at all) per GOOS/GOARCH/tags.
+func cacheKey(config matrixConfig, tags []string, importPath string) string {
+	return config.String() + "#" + strings.Join(tags, ",") + "#" + importPath
+}
+
+// testEvent mirrors one record of `go test -json`'s test2json output.
+type testEvent struct {
+	Time    time.Time `json:"Time"`
+	Action  string    `json:"Action"`
+	Package string    `json:"Package"`
+	Test    string    `json:"Test,omitempty"`
+	Elapsed float64   `json:"Elapsed,omitempty"`
+	Output  string    `json:"Output,omitempty"`
+}
+
+// testSummary is emitted once at the end of a json-format run, summarising the whole batch.
+// Config/GOOS/GOARCH identify which matrix configuration it was run under, so a consumer
+// watching more than one configuration can tell them apart.
+type testSummary struct {
+	Summary        bool     `json:"summary"`
+	Config         string   `json:"config"`
+	GOOS           string   `json:"goos,omitempty"`
+	GOARCH         string   `json:"goarch,omitempty"`
+	Packages       []string `json:"packages"`
+	Passed         int      `json:"passed"`
+	Failed         int      `json:"failed"`
+	ElapsedSeconds float64  `json:"elapsedSeconds"`
+}
+
+// fileLineRe matches the "file.go:123: message" prefix go test output uses to point at the
+// source of a failure.
+var fileLineRe = regexp.MustCompile(`^\s*([\w./-]+\.go):(\d+):\s?(.*)$`)
+
+// lspPosition and lspRange follow the LSP spec's zero-based line/character coordinates.
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+// lspDiagnostic is a single entry of a PublishDiagnosticsParams.diagnostics array.
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+// publishDiagnostics mirrors LSP's PublishDiagnosticsParams, with an extra config field (not
+// part of the LSP spec) identifying which matrix configuration produced it, so a consumer
+// watching more than one configuration can tell them apart.
+type publishDiagnostics struct {
+	URI         string          `json:"uri"`
+	Config      string          `json:"config"`
+	Diagnostics []lspDiagnostic `json:"diagnostics"`
+}
+
+// lspSeverityError is the LSP DiagnosticSeverity.Error value.
+const lspSeverityError = 1
+
+// runTests runs `go test -json` over toRun, rendering the stream in the requested format and
+// recording each package's pass/fail outcome in the test cache, keyed by the hashes already
+// computed for it in hashes. We always ask for -json under the hood, even in text mode,
+// because it's the only way to attribute a PASS/FAIL to an individual package for the cache.
+func (s *watchState) runTests(g *configGraph, toRun []*Package, hashes map[string]string, format string) error {
 	paths := make([]string, len(toRun))
 	for i, pkg := range toRun {
-		paths[i] = pkg.ImportPath
+		paths[i] = pkg.PkgPath
 	}
-	// Make these unique
-	slices.Sort(paths)
-	paths = slices.Compact(paths)
-	if len(paths) == 0 {
-		fmt.Println("No affected tests to run")
-		return nil
-	} else if len(paths) == 1 {
-		fmt.Println("Running tests in 1 package...")
-	} else {
-		fmt.Printf("Running tests in %d packages...\n", len(paths))
+	start := time.Now()
+	args := []string{"test", "-json"}
+	if len(s.tags) > 0 {
+		args = append(args, "-tags="+strings.Join(s.tags, ","))
 	}
-	args := append([]string{"test"}, paths...)
+	args = append(args, paths...)
 	cmd := exec.Command("go", args...)
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
-		return err
+	if g.config.GOOS != "" || g.config.GOARCH != "" {
+		cmd.Env = append(slices.Clone(os.Environ()), "GOOS="+g.config.GOOS, "GOARCH="+g.config.GOARCH)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to pipe go test output: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start go test: %w", err)
+	}
+	passed, failed := 0, 0
+	diagnostics := map[string][]lspDiagnostic{}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var ev testEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			continue
+		}
+		switch format {
+		case formatJSON:
+			fmt.Println(string(line))
+		case formatLSP:
+			if ev.Action == "output" {
+				collectDiagnostics(g, diagnostics, ev)
+			}
+		default:
+			if ev.Action == "output" {
+				fmt.Print(ev.Output)
+			}
+		}
+		if ev.Test == "" && (ev.Action == "pass" || ev.Action == "fail") {
+			if ev.Action == "pass" {
+				passed++
+			} else {
+				failed++
+			}
+			s.cache.record(cacheKey(g.config, s.tags, ev.Package), hashes[ev.Package], ev.Action == "pass")
+		}
+	}
+	runErr := cmd.Wait()
+	if err := s.cache.save(); err != nil {
+		fmt.Printf("Failed to save test cache: %s\n", err)
+	}
+	switch format {
+	case formatJSON:
+		summary, err := json.Marshal(testSummary{
+			Summary:        true,
+			Config:         g.config.String(),
+			GOOS:           g.config.GOOS,
+			GOARCH:         g.config.GOARCH,
+			Packages:       paths,
+			Passed:         passed,
+			Failed:         failed,
+			ElapsedSeconds: time.Since(start).Seconds(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal test summary: %w", err)
+		}
+		fmt.Println(string(summary))
+	case formatLSP:
+		for uri, diags := range diagnostics {
+			params, err := json.Marshal(publishDiagnostics{URI: uri, Config: g.config.String(), Diagnostics: diags})
+			if err != nil {
+				return fmt.Errorf("failed to marshal diagnostics: %w", err)
+			}
+			fmt.Println(string(params))
+		}
+	default:
+		if runErr == nil {
+			fmt.Println("Tests passed")
+		}
+	}
+	return runErr
+}
+
+// collectDiagnostics parses any "file.go:line:" references out of an output event and
+// accumulates them into diagnostics, keyed by file URI.
+func collectDiagnostics(g *configGraph, diagnostics map[string][]lspDiagnostic, ev testEvent) {
+	pkg, present := g.byImportPath[ev.Package]
+	if !present {
+		return
+	}
+	for _, line := range strings.Split(ev.Output, "\n") {
+		m := fileLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		lineNum, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		uri := "file://" + filepath.Join(pkg.Dir, m[1])
+		diagnostics[uri] = append(diagnostics[uri], lspDiagnostic{
+			Range: lspRange{
+				Start: lspPosition{Line: lineNum - 1},
+				End:   lspPosition{Line: lineNum - 1},
+			},
+			Severity: lspSeverityError,
+			Source:   "go test",
+			Message:  m[3],
+		})
 	}
-	fmt.Println("Tests passed")
-	return nil
 }
 
 func allFunc[S ~[]E, E any](s S, f func(E) bool) bool {